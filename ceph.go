@@ -0,0 +1,305 @@
+//-----------------------------------------------------------------------------
+// Package membership:
+//-----------------------------------------------------------------------------
+
+package main
+
+//-----------------------------------------------------------------------------
+// Imports:
+//-----------------------------------------------------------------------------
+
+import (
+
+	// Standard library:
+	"sync"
+
+	// Community:
+	"github.com/ceph/go-ceph/rados"
+	"github.com/ceph/go-ceph/rbd"
+)
+
+//-----------------------------------------------------------------------------
+// Package variable declarations:
+//-----------------------------------------------------------------------------
+
+// rbdFeatures maps the bits reported by Image.GetFeatures to the names
+// `rbd create --image-feature` (and this driver's own `image-features`
+// option) expect.
+var rbdFeatures = []struct {
+	bit  uint64
+	name string
+}{
+	{1 << 0, "layering"},
+	{1 << 1, "striping"},
+	{1 << 2, "exclusive-lock"},
+	{1 << 3, "object-map"},
+	{1 << 4, "fast-diff"},
+	{1 << 5, "deep-flatten"},
+	{1 << 6, "journaling"},
+	{1 << 7, "data-pool"},
+}
+
+//-----------------------------------------------------------------------------
+// Structs definitions:
+//-----------------------------------------------------------------------------
+
+// cephConn wraps a single librados connection and caches the IOContext for
+// every pool this driver has touched so far.
+type cephConn struct {
+	conn *rados.Conn
+
+	mu     sync.Mutex
+	ioctxs map[string]*rados.IOContext
+}
+
+//-----------------------------------------------------------------------------
+// newCephConn
+//-----------------------------------------------------------------------------
+
+func newCephConn(cluster, user, confPath, keyringPath string) (*cephConn, error) {
+
+	// rados_create2 takes the full entity name, not the bare client ID.
+	conn, err := rados.NewConnWithClusterAndUser(cluster, "client."+user)
+	if err != nil {
+		return nil, err
+	}
+
+	if confPath != "" {
+		if err := conn.ReadConfigFile(confPath); err != nil {
+			return nil, err
+		}
+	} else if err := conn.ReadDefaultConfigFile(); err != nil {
+		return nil, err
+	}
+
+	if keyringPath != "" {
+		if err := conn.SetConfigOption("keyring", keyringPath); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := conn.Connect(); err != nil {
+		return nil, err
+	}
+
+	return &cephConn{
+		conn:   conn,
+		ioctxs: make(map[string]*rados.IOContext),
+	}, nil
+}
+
+//-----------------------------------------------------------------------------
+// ioContext returns the cached IOContext for a pool, opening one on first
+// use.
+//-----------------------------------------------------------------------------
+
+func (c *cephConn) ioContext(pool string) (*rados.IOContext, error) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if ioctx, ok := c.ioctxs[pool]; ok {
+		return ioctx, nil
+	}
+
+	ioctx, err := c.conn.OpenIOContext(pool)
+	if err != nil {
+		return nil, err
+	}
+
+	c.ioctxs[pool] = ioctx
+	return ioctx, nil
+}
+
+//-----------------------------------------------------------------------------
+// listImages
+//-----------------------------------------------------------------------------
+
+func (c *cephConn) listImages(pool string) ([]string, error) {
+
+	ioctx, err := c.ioContext(pool)
+	if err != nil {
+		return nil, err
+	}
+
+	return rbd.GetImageNames(ioctx)
+}
+
+//-----------------------------------------------------------------------------
+// imageExists
+//-----------------------------------------------------------------------------
+
+func (c *cephConn) imageExists(pool, name string) (bool, error) {
+
+	names, err := c.listImages(pool)
+	if err != nil {
+		return false, err
+	}
+
+	for _, n := range names {
+		if n == name {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// imageCreateOpts carries the subset of `docker volume create --opt` options
+// that only matter at RBD image creation time.
+type imageCreateOpts struct {
+	Order       int
+	Features    uint64
+	StripeUnit  uint64
+	StripeCount uint64
+}
+
+//-----------------------------------------------------------------------------
+// createImage creates a new RBD image of sizeMB megabytes.
+//-----------------------------------------------------------------------------
+
+func (c *cephConn) createImage(pool, name string, sizeMB int, opts imageCreateOpts) error {
+
+	ioctx, err := c.ioContext(pool)
+	if err != nil {
+		return err
+	}
+
+	size := uint64(sizeMB) * 1024 * 1024
+
+	switch {
+	case opts.StripeUnit != 0 || opts.StripeCount != 0:
+		_, err = rbd.Create3(ioctx, name, size, opts.Features, opts.Order, opts.StripeUnit, opts.StripeCount)
+	case opts.Features != 0:
+		_, err = rbd.Create2(ioctx, name, size, opts.Features, opts.Order)
+	default:
+		_, err = rbd.Create(ioctx, name, size, opts.Order)
+	}
+
+	return err
+}
+
+//-----------------------------------------------------------------------------
+// imageWatched reports whether any client (on this host or another) has the
+// image open right now, by asking librbd for its list of watchers rather
+// than trusting a host-local view of /sys/bus/rbd/devices.
+//-----------------------------------------------------------------------------
+
+func (c *cephConn) imageWatched(pool, name string) (bool, error) {
+
+	ioctx, err := c.ioContext(pool)
+	if err != nil {
+		return false, err
+	}
+
+	// Open read-only so that this check does not register a watch of its
+	// own on the image header.
+	image := rbd.GetImage(ioctx, name)
+	if err := image.Open(true); err != nil {
+		return false, err
+	}
+	defer image.Close()
+
+	watchers, err := image.ListWatchers()
+	if err != nil {
+		return false, err
+	}
+
+	return len(watchers) > 0, nil
+}
+
+//-----------------------------------------------------------------------------
+// removeImage
+//-----------------------------------------------------------------------------
+
+func (c *cephConn) removeImage(pool, name string) error {
+
+	ioctx, err := c.ioContext(pool)
+	if err != nil {
+		return err
+	}
+
+	return rbd.GetImage(ioctx, name).Remove()
+}
+
+//-----------------------------------------------------------------------------
+// imageInfo returns the size in bytes and the enabled feature names of an
+// image.
+//-----------------------------------------------------------------------------
+
+func (c *cephConn) imageInfo(pool, name string) (int64, []string, error) {
+
+	ioctx, err := c.ioContext(pool)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	image := rbd.GetImage(ioctx, name)
+	if err := image.Open(); err != nil {
+		return 0, nil, err
+	}
+	defer image.Close()
+
+	size, err := image.GetSize()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	bits, err := image.GetFeatures()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return int64(size), featureNames(bits), nil
+}
+
+//-----------------------------------------------------------------------------
+// featureNames
+//-----------------------------------------------------------------------------
+
+func featureNames(bits uint64) []string {
+
+	var names []string
+	for _, f := range rbdFeatures {
+		if bits&f.bit != 0 {
+			names = append(names, f.name)
+		}
+	}
+
+	return names
+}
+
+//-----------------------------------------------------------------------------
+// featureBits
+//-----------------------------------------------------------------------------
+
+func featureBits(names []string) uint64 {
+
+	var bits uint64
+	for _, name := range names {
+		for _, f := range rbdFeatures {
+			if f.name == name {
+				bits |= f.bit
+			}
+		}
+	}
+
+	return bits
+}
+
+//-----------------------------------------------------------------------------
+// shutdown releases every cached IOContext and closes the cluster
+// connection.
+//-----------------------------------------------------------------------------
+
+func (c *cephConn) shutdown() {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, ioctx := range c.ioctxs {
+		ioctx.Destroy()
+	}
+
+	c.conn.Shutdown()
+}
@@ -12,24 +12,34 @@ import (
 
 	// Standard library:
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 
 	// Community:
-	"github.com/calavera/dkvolume"
+	"github.com/docker/go-plugins-helpers/volume"
 )
 
 //-----------------------------------------------------------------------------
 // Package variable declarations:
 //-----------------------------------------------------------------------------
 
+const (
+	// defImageOrder is the default RBD object size exponent (2^22 = 4MB
+	// objects), matching `rbd create`'s own default.
+	defImageOrder = 22
+)
+
 var (
 	nameRegex = regexp.MustCompile(`^(([-_.[:alnum:]]+)/)?([-_.[:alnum:]]+)(@([0-9]+))?$`)
-	cmds      = [...]string{"rbd", "mkfs"}
+	cmds      = [...]string{"rbd", "mkfs", "blkid", "mount", "umount"}
 )
 
 //-----------------------------------------------------------------------------
@@ -37,50 +47,100 @@ var (
 //-----------------------------------------------------------------------------
 
 type rbdDriver struct {
-	volRoot   string
-	defPool   string
-	defFsType string
-	defSize   int
-	cmd       map[string]string
+	volRoot     string
+	defPool     string
+	defFsType   string
+	defSize     int
+	cmd         map[string]string
+	ceph        *cephConn
+	allowRemove bool
+
+	// mu serializes the read-decide-act sequences in Create/Mount/Unmount/
+	// Remove; store itself is safe for concurrent use, but mapping/mounting
+	// is not atomic and must not run twice for the same key.
+	mu    sync.Mutex
+	store *store
 }
 
 //-----------------------------------------------------------------------------
 // initDriver
 //-----------------------------------------------------------------------------
 
-func initDriver(volRoot, defPool, defFsType string, defSize int) rbdDriver {
+func initDriver(volRoot, defPool, defFsType string, defSize int, cluster, user, confPath, keyringPath string, allowRemove bool) rbdDriver {
 
 	// Variables
 	var err error
 	cmd := make(map[string]string)
 
-	// Search for binaries
+	// Search for binaries still needed for kernel-level operations (`rbd
+	// map`/`unmap`, `mkfs`, `blkid` and `mount`/`umount`); everything else
+	// talks to Ceph directly through librados/librbd.
 	for _, i := range cmds {
 		cmd[i], err = exec.LookPath(i)
 		if err != nil {
-			log.Fatal("Make sure binary %s is in your PATH", i)
+			log.Fatalf("Make sure binary %s is in your PATH", i)
 		}
 	}
 
+	// Make sure the volume root exists before anything tries to read or
+	// write state underneath it.
+	if err := os.MkdirAll(volRoot, 0700); err != nil {
+		log.Fatalf("Unable to create volume root %s: %s", volRoot, err)
+	}
+
+	// Open the bbolt state store and reconcile it with reality: a previous
+	// crash may have left refcounts/mountpoints behind for krbd mappings
+	// that are no longer actually present on this host.
+	st, err := openStore(volRoot)
+	if err != nil {
+		log.Fatalf("Unable to open state store under %s: %s", volRoot, err)
+	}
+	if err := st.refresh(); err != nil {
+		log.Fatalf("Unable to refresh state store: %s", err)
+	}
+
+	ceph, err := newCephConn(cluster, user, confPath, keyringPath)
+	if err != nil {
+		log.Fatalf("Unable to connect to Ceph cluster: %s", err)
+	}
+
 	// Initialize the struct
 	driver := rbdDriver{
-		volRoot:   volRoot,
-		defPool:   defPool,
-		defFsType: defFsType,
-		defSize:   defSize,
-		cmd:       cmd,
+		volRoot:     volRoot,
+		defPool:     defPool,
+		defFsType:   defFsType,
+		defSize:     defSize,
+		cmd:         cmd,
+		ceph:        ceph,
+		allowRemove: allowRemove,
+		store:       st,
 	}
 
 	return driver
 }
 
+//-----------------------------------------------------------------------------
+// Shutdown releases the Ceph cluster connection and closes the state store.
+// It is meant to run once, on process exit, so that krbd mappings we still
+// believe are live get a chance to be reconciled correctly on the next
+// startup's refresh rather than leaving the bbolt file mid-write.
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) Shutdown() {
+	d.ceph.shutdown()
+	if err := d.store.close(); err != nil {
+		log.Printf("ERROR: closing state store: %s", err)
+	}
+}
+
 //-----------------------------------------------------------------------------
 // POST /VolumeDriver.Create
 //
 // Request:
-//  { "Name": "volume_name" }
+//  { "Name": "volume_name", "Opts": {"pool": "...", "size": "...", ...} }
 //  Instruct the plugin that the user wants to create a volume, given a user
-//  specified volume name. The plugin does not need to actually manifest the
+//  specified volume name and, optionally, a set of `docker volume create
+//  --opt` driver options. The plugin does not need to actually manifest the
 //  volume on the filesystem yet (until Mount is called).
 //
 // Response:
@@ -88,33 +148,46 @@ func initDriver(volRoot, defPool, defFsType string, defSize int) rbdDriver {
 //  Respond with a string error if an error occurred.
 //-----------------------------------------------------------------------------
 
-func (d *rbdDriver) Create(r dkvolume.Request) dkvolume.Response {
+func (d *rbdDriver) Create(r volume.Request) volume.Response {
 
 	log.Printf("[POST] /VolumeDriver.Create")
 
-	// Parse the docker --volume option
+	// Parse the legacy `pool/name@size` shortcut, then let --opt override it.
 	pool, name, size, err := d.parsePoolNameSize(r.Name)
 	if err != nil {
 		log.Printf("ERROR: parsing volume: %s", err)
-		return dkvolume.Response{Err: err.Error()}
+		return volume.Response{Err: err.Error()}
+	}
+
+	opts, err := d.buildVolumeOptions(pool, name, size, r.Options)
+	if err != nil {
+		log.Printf("ERROR: parsing volume options: %s", err)
+		return volume.Response{Err: err.Error()}
 	}
 
-	mountpoint := filepath.Join(d.volRoot, pool, name)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	mountpoint := d.mountpoint(opts.Pool, name)
 
 	// Create RBD image if not exist
-	if exists, err := d.imageExists(pool, name); !exists && err == nil {
+	if exists, err := d.imageExists(opts.Pool, name); !exists && err == nil {
 		log.Printf("Image not found, creating it now...")
-		if err = d.createImage(pool, name, d.defFsType, size); err != nil {
-			return dkvolume.Response{Err: err.Error()}
+		if err = d.createImage(opts); err != nil {
+			return volume.Response{Err: err.Error()}
 		}
 	} else if err != nil {
 		log.Printf("ERROR: checking for RBD Image: %s", err)
-		return dkvolume.Response{Err: err.Error()}
+		return volume.Response{Err: err.Error()}
+	}
+
+	if err := d.store.putVolume(name, opts); err != nil {
+		log.Printf("ERROR: saving volume record for %s: %s", name, err)
 	}
 
 	log.Printf("Mountpoint: %s", mountpoint)
 
-	return dkvolume.Response{}
+	return volume.Response{}
 }
 
 //-----------------------------------------------------------------------------
@@ -127,12 +200,146 @@ func (d *rbdDriver) Create(r dkvolume.Request) dkvolume.Response {
 //
 // Response:
 //  { "Err": null }
-//  Respond with a string error if an error occurred.
+//  Respond with a string error if an error occurred. Refuses to run while
+//  this host still has the volume mounted or mapped, and is disabled on this
+//  driver unless it was started with --allow-remove=true. Before touching the image it also
+//  asks librbd for its current watchers, which catches another Docker host
+//  still having it mapped (unlike the local /sys/bus/rbd/devices check,
+//  which only ever sees this host).
 //-----------------------------------------------------------------------------
 
-func (d *rbdDriver) Remove(r dkvolume.Request) dkvolume.Response {
+func (d *rbdDriver) Remove(r volume.Request) volume.Response {
+
 	log.Printf("Remove: %s", r.Name)
-	return dkvolume.Response{}
+
+	if !d.allowRemove {
+		return volume.Response{Err: "removal disabled: this driver was started with --allow-remove=false"}
+	}
+
+	_, name, _, err := d.parsePoolNameSize(r.Name)
+	if err != nil {
+		return volume.Response{Err: err.Error()}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	pool := d.resolvePool(name)
+
+	if ms, err := d.store.getMount(name); err != nil {
+		return volume.Response{Err: err.Error()}
+	} else if ms != nil && ms.Refcount > 0 {
+		return volume.Response{Err: fmt.Sprintf("volume %s is still mounted (refcount %d)", name, ms.Refcount)}
+	}
+
+	if d.isImageMapped(pool, name) {
+		return volume.Response{Err: fmt.Sprintf("volume %s is still mapped on this host", name)}
+	}
+
+	if watched, err := d.ceph.imageWatched(pool, name); err != nil {
+		log.Printf("ERROR: checking watchers on RBD image %s/%s: %s", pool, name, err)
+		return volume.Response{Err: err.Error()}
+	} else if watched {
+		return volume.Response{Err: fmt.Sprintf("volume %s is still mapped on another host (image has active watchers)", name)}
+	}
+
+	if err := d.ceph.removeImage(pool, name); err != nil {
+		log.Printf("ERROR: removing RBD image %s/%s: %s", pool, name, err)
+		return volume.Response{Err: fmt.Sprintf("removing image %s/%s: %s", pool, name, err)}
+	}
+
+	if err := os.RemoveAll(d.mountpoint(pool, name)); err != nil {
+		log.Printf("ERROR: removing mountpoint directory for %s: %s", name, err)
+	}
+
+	if err := d.store.deleteVolume(name); err != nil {
+		log.Printf("ERROR: deleting volume record for %s: %s", name, err)
+	}
+	if err := d.store.deleteMount(name); err != nil {
+		log.Printf("ERROR: deleting mount record for %s: %s", name, err)
+	}
+
+	return volume.Response{}
+}
+
+//-----------------------------------------------------------------------------
+// POST /VolumeDriver.Get
+//
+// Request:
+//  { "Name": "volume_name" }
+//  Docker needs the volume's mountpoint and any known status so it can
+//  satisfy `docker volume inspect`.
+//
+// Response:
+//  { "Volume": { "Name": "volume_name", "Mountpoint": "/path", "Status": {...} } }
+//  Respond with a string error if an error occurred.
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) Get(r volume.Request) volume.Response {
+
+	log.Printf("Get: %s", r.Name)
+
+	_, name, _, err := d.parsePoolNameSize(r.Name)
+	if err != nil {
+		return volume.Response{Err: err.Error()}
+	}
+
+	pool := d.resolvePool(name)
+
+	if exists, err := d.imageExists(pool, name); err != nil {
+		return volume.Response{Err: err.Error()}
+	} else if !exists {
+		return volume.Response{Err: fmt.Sprintf("no such image %s/%s", pool, name)}
+	}
+
+	return volume.Response{Volume: d.describeVolume(pool, name, r.Name)}
+}
+
+//-----------------------------------------------------------------------------
+// POST /VolumeDriver.List
+//
+// Request:
+//  {}
+//  Docker needs every volume this driver knows about so it can satisfy
+//  `docker volume ls`.
+//
+// Response:
+//  { "Volumes": [ { "Name": "volume_name", "Mountpoint": "/path" } ] }
+//  Respond with a string error if an error occurred.
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) List(r volume.Request) volume.Response {
+
+	log.Printf("List")
+
+	names, err := d.listImages(d.defPool)
+	if err != nil {
+		return volume.Response{Err: err.Error()}
+	}
+
+	volumes := make([]*volume.Volume, 0, len(names))
+	for _, name := range names {
+		volumes = append(volumes, d.describeVolume(d.defPool, name, d.defPool+"/"+name))
+	}
+
+	return volume.Response{Volumes: volumes}
+}
+
+//-----------------------------------------------------------------------------
+// POST /VolumeDriver.Capabilities
+//
+// Request:
+//  {}
+//
+// Response:
+//  { "Capabilities": { "Scope": "global" } }
+//  RBD images live in a Ceph cluster shared by every Docker host, so the
+//  scope is global rather than local.
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) Capabilities(r volume.Request) volume.Response {
+	log.Printf("Capabilities")
+	return volume.Response{Capabilities: volume.Capability{Scope: "global"}}
 }
 
 //-----------------------------------------------------------------------------
@@ -148,9 +355,16 @@ func (d *rbdDriver) Remove(r dkvolume.Request) dkvolume.Response {
 //  made available, and/or a string error if an error occurred.
 //-----------------------------------------------------------------------------
 
-func (d *rbdDriver) Path(r dkvolume.Request) dkvolume.Response {
+func (d *rbdDriver) Path(r volume.Request) volume.Response {
+
 	log.Printf("Path: %s", r.Name)
-	return dkvolume.Response{Mountpoint: "/path/to/directory/on/host"}
+
+	_, name, _, err := d.parsePoolNameSize(r.Name)
+	if err != nil {
+		return volume.Response{Err: err.Error()}
+	}
+
+	return volume.Response{Mountpoint: d.mountpoint(d.resolvePool(name), name)}
 }
 
 //-----------------------------------------------------------------------------
@@ -167,9 +381,77 @@ func (d *rbdDriver) Path(r dkvolume.Request) dkvolume.Response {
 //  made available, and/or a string error if an error occurred.
 //-----------------------------------------------------------------------------
 
-func (d *rbdDriver) Mount(r dkvolume.Request) dkvolume.Response {
+func (d *rbdDriver) Mount(r volume.MountRequest) volume.Response {
+
 	log.Printf("Mount: %s", r.Name)
-	return dkvolume.Response{Mountpoint: "/path/to/directory/on/host"}
+
+	_, name, _, err := d.parsePoolNameSize(r.Name)
+	if err != nil {
+		return volume.Response{Err: err.Error()}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ms, err := d.store.getMount(name)
+	if err != nil {
+		return volume.Response{Err: err.Error()}
+	}
+	if ms == nil {
+		ms = &mountRecord{}
+	}
+
+	opts, err := d.store.getVolume(name)
+	if err != nil {
+		return volume.Response{Err: err.Error()}
+	}
+	pool := d.defPool
+	fstype := d.defFsType
+	var mkfsOptions []string
+	if opts != nil {
+		pool = opts.Pool
+		fstype = opts.FsType
+		mkfsOptions = opts.MkfsOptions
+	}
+
+	mountpoint := d.mountpoint(pool, name)
+
+	// Only the first consumer actually maps/mounts the image. Every
+	// subsequent Mount call for the same name just bumps the refcount.
+	if ms.Refcount == 0 {
+
+		device, err := d.mapImage(pool, name)
+		if err != nil {
+			log.Printf("ERROR: mapping RBD image %s/%s: %s", pool, name, err)
+			return volume.Response{Err: err.Error()}
+		}
+
+		if err := d.ensureFilesystem(device, fstype, mkfsOptions); err != nil {
+			log.Printf("ERROR: preparing filesystem on %s: %s", device, err)
+			d.unmapImage(device)
+			return volume.Response{Err: err.Error()}
+		}
+
+		if err := d.mountDevice(device, mountpoint); err != nil {
+			log.Printf("ERROR: mounting %s at %s: %s", device, mountpoint, err)
+			d.unmapImage(device)
+			return volume.Response{Err: err.Error()}
+		}
+
+		ms.Device = device
+		ms.Mountpoint = mountpoint
+	}
+
+	ms.Refcount++
+	if r.ID != "" {
+		ms.OwnerContainerIDs = append(ms.OwnerContainerIDs, r.ID)
+	}
+
+	if err := d.store.putMount(name, ms); err != nil {
+		log.Printf("ERROR: saving mount record for %s: %s", name, err)
+	}
+
+	return volume.Response{Mountpoint: mountpoint}
 }
 
 //-----------------------------------------------------------------------------
@@ -186,9 +468,79 @@ func (d *rbdDriver) Mount(r dkvolume.Request) dkvolume.Response {
 //  Respond with a string error if an error occurred.
 //-----------------------------------------------------------------------------
 
-func (d *rbdDriver) Unmount(r dkvolume.Request) dkvolume.Response {
+func (d *rbdDriver) Unmount(r volume.UnmountRequest) volume.Response {
+
 	log.Printf("Umount: %s", r.Name)
-	return dkvolume.Response{}
+
+	_, name, _, err := d.parsePoolNameSize(r.Name)
+	if err != nil {
+		return volume.Response{Err: err.Error()}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ms, err := d.store.getMount(name)
+	if err != nil {
+		return volume.Response{Err: err.Error()}
+	}
+	if ms == nil || ms.Refcount == 0 {
+		log.Printf("Unmount: %s is not mounted, ignoring", name)
+		return volume.Response{}
+	}
+
+	ms.Refcount--
+	ms.OwnerContainerIDs = removeContainerID(ms.OwnerContainerIDs, r.ID)
+
+	// Only the last consumer tears the mapping down.
+	if ms.Refcount == 0 {
+
+		mountpoint := d.mountpoint(d.resolvePool(name), name)
+
+		if err := d.unmountDevice(mountpoint); err != nil {
+			log.Printf("ERROR: unmounting %s: %s", mountpoint, err)
+			ms.Refcount++
+			return volume.Response{Err: err.Error()}
+		}
+
+		if err := d.unmapImage(ms.Device); err != nil {
+			log.Printf("ERROR: unmapping %s: %s", ms.Device, err)
+			ms.Refcount++
+			return volume.Response{Err: err.Error()}
+		}
+
+		if err := d.store.deleteMount(name); err != nil {
+			log.Printf("ERROR: deleting mount record for %s: %s", name, err)
+		}
+
+		return volume.Response{}
+	}
+
+	if err := d.store.putMount(name, ms); err != nil {
+		log.Printf("ERROR: saving mount record for %s: %s", name, err)
+	}
+
+	return volume.Response{}
+}
+
+//-----------------------------------------------------------------------------
+// removeContainerID
+//-----------------------------------------------------------------------------
+
+func removeContainerID(ids []string, id string) []string {
+
+	if id == "" {
+		return ids
+	}
+
+	out := ids[:0]
+	for _, existing := range ids {
+		if existing != id {
+			out = append(out, existing)
+		}
+	}
+
+	return out
 }
 
 //-----------------------------------------------------------------------------
@@ -225,46 +577,232 @@ func (d *rbdDriver) parsePoolNameSize(src string) (string, string, int, error) {
 	return pool, name, size, nil
 }
 
+//-----------------------------------------------------------------------------
+// resolvePool returns the pool a volume actually lives in, i.e. whatever
+// `--opt pool=` it was created with. The name alone, as parsed out of a
+// Docker request, is not enough: Create persists the effective pool chosen
+// via buildVolumeOptions, which can differ from the default/parsed one, so
+// every other handler must look it up the same way rather than recomputing
+// it from the name.
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) resolvePool(name string) string {
+
+	opts, err := d.store.getVolume(name)
+	if err != nil || opts == nil {
+		return d.defPool
+	}
+
+	return opts.Pool
+}
+
 //-----------------------------------------------------------------------------
 // imageExists
 //-----------------------------------------------------------------------------
 
 func (d *rbdDriver) imageExists(pool, name string) (bool, error) {
+	return d.ceph.imageExists(pool, name)
+}
+
+//-----------------------------------------------------------------------------
+// listImages
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) listImages(pool string) ([]string, error) {
+	return d.ceph.listImages(pool)
+}
+
+//-----------------------------------------------------------------------------
+// describeVolume builds the volume.Volume representation Get/List respond
+// with, including the best-effort Status map Docker shows on `volume
+// inspect`. respName is what's reported back as Name: Get must echo exactly
+// what Docker asked for (it keys its own volume store by that string), while
+// List has no such request to echo and uses the pool/name form instead.
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) describeVolume(pool, name, respName string) *volume.Volume {
+
+	status := map[string]interface{}{}
 
-	// List RBD images
-	out, err := exec.Command(d.cmd["rbd"], "ls", pool).Output()
+	if size, features, err := d.imageInfo(pool, name); err == nil {
+		status["size"] = size
+		status["features"] = features
+	}
+
+	ms, err := d.store.getMount(name)
+	if err != nil {
+		log.Printf("ERROR: reading mount record for %s: %s", name, err)
+	}
+	opts, err := d.store.getVolume(name)
 	if err != nil {
-		return false, err
+		log.Printf("ERROR: reading volume record for %s: %s", name, err)
 	}
 
-	// Parse the output
-	list := strings.Split(string(out), "\n")
-	for _, item := range list {
-		if item == name {
-			return true, nil
-		}
+	status["mapped"] = ms != nil && ms.Refcount > 0
+	if ms != nil {
+		status["device"] = ms.Device
+	}
+	if opts != nil {
+		status["fstype"] = opts.FsType
+		status["createdAt"] = opts.CreatedAt
+	}
+
+	return &volume.Volume{
+		Name:       respName,
+		Mountpoint: d.mountpoint(pool, name),
+		Status:     status,
 	}
+}
+
+//-----------------------------------------------------------------------------
+// imageInfo asks librbd for the size (in bytes) and enabled image features
+// of the given image.
+//-----------------------------------------------------------------------------
 
-	return false, nil
+func (d *rbdDriver) imageInfo(pool, name string) (int64, []string, error) {
+	return d.ceph.imageInfo(pool, name)
 }
 
 //-----------------------------------------------------------------------------
 // createImage
 //-----------------------------------------------------------------------------
 
-func (d *rbdDriver) createImage(pool, name, fstype string, size int) error {
+func (d *rbdDriver) createImage(opts *volumeOptions) error {
+	return d.ceph.createImage(opts.Pool, opts.Name, opts.Size, imageCreateOpts{
+		Order:       opts.Order,
+		Features:    featureBits(opts.ImageFeatures),
+		StripeUnit:  uint64(opts.StripeUnit),
+		StripeCount: uint64(opts.StripeCount),
+	})
+}
+
+//-----------------------------------------------------------------------------
+// mountpoint
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) mountpoint(pool, name string) string {
+	return filepath.Join(d.volRoot, pool, name)
+}
+
+//-----------------------------------------------------------------------------
+// mapImage maps the RBD image to a kernel block device (e.g. /dev/rbd0) and
+// returns the device path reported by `rbd map`.
+//-----------------------------------------------------------------------------
 
-	// Create the block device
-	err := exec.Command(
-		d.cmd["rbd"], "create",
-		"--pool", pool,
-		"--size", strconv.Itoa(size),
-		name,
-	).Run()
+func (d *rbdDriver) mapImage(pool, name string) (string, error) {
 
+	out, err := exec.Command(d.cmd["rbd"], "map", "--pool", pool, name).Output()
 	if err != nil {
+		return "", err
+	}
+
+	device := strings.TrimSpace(string(out))
+	if device == "" {
+		return "", fmt.Errorf("rbd map did not return a device for %s/%s", pool, name)
+	}
+
+	return device, nil
+}
+
+//-----------------------------------------------------------------------------
+// unmapImage
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) unmapImage(device string) error {
+	return exec.Command(d.cmd["rbd"], "unmap", device).Run()
+}
+
+//-----------------------------------------------------------------------------
+// isImageMapped reports whether pool/name is currently mapped to a krbd
+// device on this host, by walking /sys/bus/rbd/devices rather than trusting
+// the refcount in the state store (which a previous crash may have left stale).
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) isImageMapped(pool, name string) bool {
+
+	const devicesDir = "/sys/bus/rbd/devices"
+
+	entries, err := ioutil.ReadDir(devicesDir)
+	if err != nil {
+		return false
+	}
+
+	for _, entry := range entries {
+
+		devPool, err := ioutil.ReadFile(filepath.Join(devicesDir, entry.Name(), "pool"))
+		if err != nil {
+			continue
+		}
+
+		devName, err := ioutil.ReadFile(filepath.Join(devicesDir, entry.Name(), "name"))
+		if err != nil {
+			continue
+		}
+
+		if strings.TrimSpace(string(devPool)) == pool && strings.TrimSpace(string(devName)) == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+//-----------------------------------------------------------------------------
+// ensureFilesystem runs mkfs on the device only if it is not already
+// formatted, as reported by blkid.
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) ensureFilesystem(device, fstype string, mkfsOptions []string) error {
+
+	if d.hasFilesystem(device) {
+		return nil
+	}
+
+	log.Printf("No filesystem found on %s, running mkfs.%s", device, fstype)
+
+	args := []string{"-t", fstype}
+	switch {
+	case len(mkfsOptions) > 0:
+		args = append(args, mkfsOptions...)
+	case fstype == "xfs":
+		args = append(args, "-f", "-i", "size=2048")
+	}
+	args = append(args, device)
+
+	return exec.Command(d.cmd["mkfs"], args...).Run()
+}
+
+//-----------------------------------------------------------------------------
+// hasFilesystem
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) hasFilesystem(device string) bool {
+
+	out, err := exec.Command(d.cmd["blkid"], "-o", "value", "-s", "TYPE", device).Output()
+	if err != nil {
+		return false
+	}
+
+	return strings.TrimSpace(string(out)) != ""
+}
+
+//-----------------------------------------------------------------------------
+// mountDevice
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) mountDevice(device, mountpoint string) error {
+
+	if err := os.MkdirAll(mountpoint, 0755); err != nil {
 		return err
 	}
 
-	return nil
+	return exec.Command(d.cmd["mount"], device, mountpoint).Run()
+}
+
+//-----------------------------------------------------------------------------
+// unmountDevice
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) unmountDevice(mountpoint string) error {
+	return exec.Command(d.cmd["umount"], mountpoint).Run()
 }
@@ -25,10 +25,12 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 
 	// Community:
-	"github.com/calavera/dkvolume"
+	"github.com/docker/go-plugins-helpers/volume"
 )
 
 //-----------------------------------------------------------------------------
@@ -36,8 +38,7 @@ import (
 //-----------------------------------------------------------------------------
 
 const (
-	id            = "rbd"
-	socketAddress = "/var/run/docker/plugins/rbd.sock"
+	id = "rbd"
 )
 
 //-----------------------------------------------------------------------------
@@ -47,13 +48,22 @@ const (
 var (
 
 	// Predefined defaults:
-	defVolRoot = filepath.Join(dkvolume.DefaultDockerRootDirectory, id)
+	defVolRoot = filepath.Join(volume.DefaultDockerRootDirectory, id)
 
 	// Flags:
 	volRoot   = flag.String("volroot", defVolRoot, "Docker volumes root directory")
 	defPool   = flag.String("pool", "rbd", "Default Ceph pool for RBD operations")
 	defSize   = flag.Int("size", 2048, "Default block device image size")
 	defFsType = flag.String("fsType", "xfs", "Default file system type for new images")
+
+	// Ceph cluster connectivity:
+	cephCluster = flag.String("cluster", "ceph", "Name of the Ceph cluster to connect to")
+	cephUser    = flag.String("user", "admin", "Ceph user (cephx client ID) to authenticate as")
+	cephConf    = flag.String("conf", "", "Path to ceph.conf (defaults to the standard /etc/ceph search path)")
+	cephKeyring = flag.String("keyring", "", "Path to a keyring file (defaults to what ceph.conf/cephx resolve)")
+
+	// Safety:
+	allowRemove = flag.Bool("allow-remove", false, "Allow docker volume rm to delete the underlying RBD image (defaults to false to protect a shared cluster; opt in explicitly)")
 )
 
 //-----------------------------------------------------------------------------
@@ -91,10 +101,21 @@ func usage() {
 func main() {
 
 	// Request handler with a driver implementation
-	d := initDriver(*volRoot, *defPool, *defFsType, *defSize)
-	h := dkvolume.NewHandler(&d)
-
-	// Listen for requests in a unix socket:
-	log.Printf("Listening on %s\n", socketAddress)
-	fmt.Println(h.ServeUnix("", socketAddress))
+	d := initDriver(*volRoot, *defPool, *defFsType, *defSize, *cephCluster, *cephUser, *cephConf, *cephKeyring, *allowRemove)
+	h := volume.NewHandler(&d)
+
+	// Release the Ceph connection and close the state store cleanly on
+	// SIGINT/SIGTERM instead of leaking them when the process is killed.
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		s := <-sig
+		log.Printf("Received %s, shutting down\n", s)
+		d.Shutdown()
+		os.Exit(0)
+	}()
+
+	// Listen for requests in a unix socket, named after the plugin id:
+	log.Printf("Listening under plugin id %s\n", id)
+	fmt.Println(h.ServeUnix(id, 0))
 }
@@ -0,0 +1,105 @@
+//-----------------------------------------------------------------------------
+// Package membership:
+//-----------------------------------------------------------------------------
+
+package main
+
+//-----------------------------------------------------------------------------
+// Imports:
+//-----------------------------------------------------------------------------
+
+import (
+
+	// Standard library:
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//-----------------------------------------------------------------------------
+// Structs definitions:
+//-----------------------------------------------------------------------------
+
+// volumeOptions holds everything that was chosen at `docker volume create`
+// time (either via `--opt` or the legacy `pool/name@size` shortcut) and that
+// RBD itself has no way of reporting back, such as the filesystem type. It
+// is also the value stored in the "volumes" bucket of the state store.
+type volumeOptions struct {
+	Pool          string   `json:"pool"`
+	Name          string   `json:"name"`
+	Size          int      `json:"size"`
+	FsType        string   `json:"fstype"`
+	Order         int      `json:"order,omitempty"`
+	ImageFeatures []string `json:"imageFeatures,omitempty"`
+	StripeUnit    int      `json:"stripeUnit,omitempty"`
+	StripeCount   int      `json:"stripeCount,omitempty"`
+	MkfsOptions   []string `json:"mkfsOptions,omitempty"`
+	CreatedAt     string   `json:"createdAt,omitempty"`
+}
+
+//-----------------------------------------------------------------------------
+// buildVolumeOptions merges the legacy `pool/name@size` shortcut with the
+// `--opt` map modern Docker sends on `docker volume create`. Options take
+// precedence over whatever was parsed out of the volume name.
+//-----------------------------------------------------------------------------
+
+func (d *rbdDriver) buildVolumeOptions(pool, name string, size int, raw map[string]string) (*volumeOptions, error) {
+
+	opts := &volumeOptions{
+		Pool:   pool,
+		Name:   name,
+		Size:   size,
+		FsType: d.defFsType,
+		Order:  defImageOrder,
+	}
+
+	if v, ok := raw["pool"]; ok && v != "" {
+		opts.Pool = v
+	}
+
+	if v, ok := raw["size"]; ok && v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid size option %q: %s", v, err)
+		}
+		opts.Size = n
+	}
+
+	if v, ok := raw["fstype"]; ok && v != "" {
+		opts.FsType = v
+	}
+
+	if v, ok := raw["order"]; ok && v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid order option %q: %s", v, err)
+		}
+		opts.Order = n
+	}
+
+	if v, ok := raw["image-features"]; ok && v != "" {
+		opts.ImageFeatures = strings.Split(v, ",")
+	}
+
+	if v, ok := raw["stripe-unit"]; ok && v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid stripe-unit option %q: %s", v, err)
+		}
+		opts.StripeUnit = n
+	}
+
+	if v, ok := raw["stripe-count"]; ok && v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid stripe-count option %q: %s", v, err)
+		}
+		opts.StripeCount = n
+	}
+
+	if v, ok := raw["mkfs-options"]; ok && v != "" {
+		opts.MkfsOptions = strings.Fields(v)
+	}
+
+	return opts, nil
+}
@@ -0,0 +1,248 @@
+//-----------------------------------------------------------------------------
+// Package membership:
+//-----------------------------------------------------------------------------
+
+package main
+
+//-----------------------------------------------------------------------------
+// Imports:
+//-----------------------------------------------------------------------------
+
+import (
+
+	// Standard library:
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	// Community:
+	"go.etcd.io/bbolt"
+)
+
+//-----------------------------------------------------------------------------
+// Package variable declarations:
+//-----------------------------------------------------------------------------
+
+var (
+	volumesBucket = []byte("volumes")
+	mountsBucket  = []byte("mounts")
+)
+
+//-----------------------------------------------------------------------------
+// Structs definitions:
+//-----------------------------------------------------------------------------
+
+// mountRecord tracks the current krbd mapping and the containers keeping it
+// alive, keyed by volume name, same as a volumeOptions entry.
+type mountRecord struct {
+	Refcount          int      `json:"refcount"`
+	Device            string   `json:"device"`
+	Mountpoint        string   `json:"mountpoint"`
+	OwnerContainerIDs []string `json:"ownerContainerIds,omitempty"`
+}
+
+// store is the bbolt-backed state store under volRoot/state.db:
+// a "volumes" bucket holding what Create learned, and a "mounts" bucket
+// holding what Mount/Unmount currently believe is krbd-mapped.
+type store struct {
+	db *bbolt.DB
+}
+
+//-----------------------------------------------------------------------------
+// openStore
+//-----------------------------------------------------------------------------
+
+func openStore(volRoot string) (*store, error) {
+
+	db, err := bbolt.Open(filepath.Join(volRoot, "state.db"), 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(volumesBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(mountsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &store{db: db}, nil
+}
+
+//-----------------------------------------------------------------------------
+// close
+//-----------------------------------------------------------------------------
+
+func (s *store) close() error {
+	return s.db.Close()
+}
+
+//-----------------------------------------------------------------------------
+// getVolume
+//-----------------------------------------------------------------------------
+
+func (s *store) getVolume(key string) (*volumeOptions, error) {
+
+	var rec *volumeOptions
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket(volumesBucket).Get([]byte(key))
+		if data == nil {
+			return nil
+		}
+		rec = &volumeOptions{}
+		return json.Unmarshal(data, rec)
+	})
+
+	return rec, err
+}
+
+//-----------------------------------------------------------------------------
+// putVolume
+//-----------------------------------------------------------------------------
+
+func (s *store) putVolume(key string, rec *volumeOptions) error {
+
+	if rec.CreatedAt == "" {
+		rec.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+	}
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(volumesBucket).Put([]byte(key), data)
+	})
+}
+
+//-----------------------------------------------------------------------------
+// deleteVolume
+//-----------------------------------------------------------------------------
+
+func (s *store) deleteVolume(key string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(volumesBucket).Delete([]byte(key))
+	})
+}
+
+//-----------------------------------------------------------------------------
+// getMount
+//-----------------------------------------------------------------------------
+
+func (s *store) getMount(key string) (*mountRecord, error) {
+
+	var rec *mountRecord
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket(mountsBucket).Get([]byte(key))
+		if data == nil {
+			return nil
+		}
+		rec = &mountRecord{}
+		return json.Unmarshal(data, rec)
+	})
+
+	return rec, err
+}
+
+//-----------------------------------------------------------------------------
+// putMount
+//-----------------------------------------------------------------------------
+
+func (s *store) putMount(key string, rec *mountRecord) error {
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(mountsBucket).Put([]byte(key), data)
+	})
+}
+
+//-----------------------------------------------------------------------------
+// deleteMount
+//-----------------------------------------------------------------------------
+
+func (s *store) deleteMount(key string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(mountsBucket).Delete([]byte(key))
+	})
+}
+
+//-----------------------------------------------------------------------------
+// refresh reconciles the "mounts" bucket with reality at startup: any device
+// it remembers that is no longer present under /sys/bus/rbd/devices means
+// the plugin (or the host) restarted without a clean Unmount, so the
+// refcount and mountpoint for that entry are stale and must be dropped.
+//-----------------------------------------------------------------------------
+
+func (s *store) refresh() error {
+
+	live := liveRbdDevices()
+
+	return s.db.Update(func(tx *bbolt.Tx) error {
+
+		bucket := tx.Bucket(mountsBucket)
+
+		var stale [][]byte
+		err := bucket.ForEach(func(k, v []byte) error {
+
+			rec := &mountRecord{}
+			if err := json.Unmarshal(v, rec); err != nil {
+				return err
+			}
+
+			if !live[rec.Device] {
+				log.Printf("refresh: %s was not found mapped at %s, dropping stale mount state", string(k), rec.Device)
+				stale = append(stale, append([]byte(nil), k...))
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range stale {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+//-----------------------------------------------------------------------------
+// liveRbdDevices lists the krbd device nodes currently mapped on this host.
+//-----------------------------------------------------------------------------
+
+func liveRbdDevices() map[string]bool {
+
+	const devicesDir = "/sys/bus/rbd/devices"
+
+	live := make(map[string]bool)
+
+	entries, err := ioutil.ReadDir(devicesDir)
+	if err != nil {
+		return live
+	}
+
+	for _, entry := range entries {
+		live["/dev/rbd"+strings.TrimSpace(entry.Name())] = true
+	}
+
+	return live
+}